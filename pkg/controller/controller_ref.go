@@ -0,0 +1,119 @@
+/*
+Copyright 2014 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/json"
+
+	"code.google.com/p/go.net/context"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/labels"
+	"github.com/golang/glog"
+)
+
+// controllerRefLabelKey records, on a pod, the ID of the ReplicationController
+// that created or adopted it. The API doesn't have a first-class
+// ControllerRef field yet, so this label is the pod's controller ref until
+// it does.
+const controllerRefLabelKey = "kubernetesController"
+
+// getControllerRef returns the ID of the controller pod is currently bound
+// to, or "" if it isn't bound to one.
+func getControllerRef(pod api.Pod) string {
+	return pod.Labels[controllerRefLabelKey]
+}
+
+// controllerRefPatch builds the patch body that sets (or, for an empty
+// controllerID, clears) a pod's controller ref label.
+func controllerRefPatch(controllerID string) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"labels": map[string]string{controllerRefLabelKey: controllerID},
+	})
+}
+
+// adoptOrphan reconciles controllerSpec's ControllerRefs against matching, the
+// set of pods whose labels currently match controllerSpec's selector. Pods in
+// matching with no controller ref are adopted (patched to point at
+// controllerSpec); pods that carry controllerSpec's ref but are not in
+// matching are released (patched to clear it). It returns the pods that
+// belong to controllerSpec once adoption has been applied, which is what the
+// create/delete diff should be computed against.
+func (rm *ReplicationManager) adoptOrphan(ctx context.Context, controllerSpec api.ReplicationController, matching []api.Pod) ([]api.Pod, error) {
+	matchingIDs := make(map[string]bool, len(matching))
+	var owned []api.Pod
+	for _, pod := range matching {
+		matchingIDs[pod.ID] = true
+		switch getControllerRef(pod) {
+		case controllerSpec.ID:
+			owned = append(owned, pod)
+		case "":
+			if err := rm.patchControllerRef(ctx, controllerSpec.Namespace, pod.ID, controllerSpec.ID); err != nil {
+				glog.Errorf("Failed to adopt pod %v for controller %v: %v", pod.ID, controllerSpec.ID, err)
+				continue
+			}
+			owned = append(owned, pod)
+		default:
+			// Matches controllerSpec's selector but belongs to a different
+			// controller; leave it alone.
+		}
+	}
+
+	all, err := rm.podStore.List(labels.Everything())
+	if err != nil {
+		return owned, err
+	}
+	for _, pod := range filterByNamespace(all, controllerSpec.Namespace) {
+		if getControllerRef(pod) != controllerSpec.ID || matchingIDs[pod.ID] {
+			continue
+		}
+		if err := rm.patchControllerRef(ctx, controllerSpec.Namespace, pod.ID, ""); err != nil {
+			glog.Errorf("Failed to release pod %v from controller %v: %v", pod.ID, controllerSpec.ID, err)
+		}
+	}
+	return owned, nil
+}
+
+func (rm *ReplicationManager) patchControllerRef(ctx context.Context, namespace, podID, controllerID string) error {
+	patch, err := controllerRefPatch(controllerID)
+	if err != nil {
+		return err
+	}
+	return rm.podControl.patchPod(ctx, namespace, podID, patch)
+}
+
+// releaseControllerRef clears the controller ref of every pod in namespace
+// that's currently stamped with id. It must be called when the controller
+// named id is deleted: the ref label is keyed on the controller's name, not
+// a UID, so without this a later controller created with the same name
+// would see adoptOrphan's ref-match fast path already satisfied and silently
+// absorb its predecessor's leftover pods instead of treating them as
+// unrelated.
+func (rm *ReplicationManager) releaseControllerRef(ctx context.Context, namespace, id string) error {
+	all, err := rm.podStore.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	for _, pod := range filterByNamespace(all, namespace) {
+		if getControllerRef(pod) != id {
+			continue
+		}
+		if err := rm.patchControllerRef(ctx, namespace, pod.ID, ""); err != nil {
+			glog.Errorf("Failed to release pod %v from deleted controller %v: %v", pod.ID, id, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2014 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
+)
+
+// expectationsTimeout is how long we wait for a create/delete we issued to be
+// observed before we give up on it and let the controller sync again. Without
+// this, a pod event lost between the apiserver and our watch would wedge the
+// controller forever.
+const expectationsTimeout = 5 * time.Minute
+
+// ControlleeExpectations tracks the number of creates and deletes a single
+// controller's last sync issued but that we haven't yet observed happening.
+type ControlleeExpectations struct {
+	add       int
+	del       int
+	timestamp time.Time
+}
+
+// Fulfilled returns true if every create/delete this expectation recorded has
+// been observed, or if the expectation is older than expectationsTimeout.
+func (e *ControlleeExpectations) Fulfilled() bool {
+	if e.add <= 0 && e.del <= 0 {
+		return true
+	}
+	return time.Now().After(e.timestamp.Add(expectationsTimeout))
+}
+
+// ControllerExpectations tracks, per-controller, the pod creates and deletes
+// a sync has started but not yet seen completed. syncReplicationController
+// uses it to avoid issuing the same creates/deletes again before a previous
+// sync's effects have shown up in the pod list.
+type ControllerExpectations struct {
+	sync.RWMutex
+	items map[string]*ControlleeExpectations
+}
+
+// NewControllerExpectations returns a new, empty ControllerExpectations.
+func NewControllerExpectations() *ControllerExpectations {
+	return &ControllerExpectations{
+		items: map[string]*ControlleeExpectations{},
+	}
+}
+
+// key is the cache key for an expectation. It matches the "namespace/name"
+// format the workqueue and controllerStore key their entries by, so a
+// controller in one namespace can't collide with a same-named one in another.
+func key(rc api.ReplicationController) string {
+	return rc.Namespace + "/" + rc.ID
+}
+
+// ExpectCreations records that rc's last sync started creating add pods that
+// we haven't observed yet.
+func (r *ControllerExpectations) ExpectCreations(rc api.ReplicationController, add int) {
+	r.setExpectations(rc, add, 0)
+}
+
+// ExpectDeletions records that rc's last sync started deleting del pods that
+// we haven't observed yet.
+func (r *ControllerExpectations) ExpectDeletions(rc api.ReplicationController, del int) {
+	r.setExpectations(rc, 0, del)
+}
+
+func (r *ControllerExpectations) setExpectations(rc api.ReplicationController, add, del int) {
+	if add == 0 && del == 0 {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.items[key(rc)] = &ControlleeExpectations{
+		add:       add,
+		del:       del,
+		timestamp: time.Now(),
+	}
+}
+
+// CreationObserved records that one of rc's expected creates has been
+// observed, e.g. via a watch event for the newly created pod.
+func (r *ControllerExpectations) CreationObserved(rc api.ReplicationController) {
+	r.Lock()
+	defer r.Unlock()
+	if exp, exists := r.items[key(rc)]; exists {
+		exp.add--
+	}
+}
+
+// DeletionObserved records that one of rc's expected deletes has been
+// observed, e.g. via a watch event for the deleted pod.
+func (r *ControllerExpectations) DeletionObserved(rc api.ReplicationController) {
+	r.Lock()
+	defer r.Unlock()
+	if exp, exists := r.items[key(rc)]; exists {
+		exp.del--
+	}
+}
+
+// SatisfiedExpectations returns true if rc has no outstanding creates or
+// deletes we're still waiting to observe, or if its expectations have gone
+// stale. A controller with unsatisfied expectations should not be synced,
+// since a sync would recompute the same diff and double up on pod ops.
+func (r *ControllerExpectations) SatisfiedExpectations(rc api.ReplicationController) bool {
+	r.RLock()
+	defer r.RUnlock()
+	if exp, exists := r.items[key(rc)]; exists {
+		return exp.Fulfilled()
+	}
+	return true
+}
+
+// DeleteExpectations drops rc's tracked expectations. It must be called when
+// a controller is deleted so that a later controller reusing the same name
+// doesn't inherit a stale (and possibly never-to-be-satisfied) entry.
+func (r *ControllerExpectations) DeleteExpectations(rc api.ReplicationController) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.items, key(rc))
+}
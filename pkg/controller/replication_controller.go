@@ -0,0 +1,368 @@
+/*
+Copyright 2014 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package controller contains logic for watching and synchronizing
+// ReplicationControllers.
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.net/context"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/client"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/client/cache"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/controller/framework"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/labels"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/runtime"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/util"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/util/workqueue"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/watch"
+	"github.com/golang/glog"
+)
+
+const (
+	// FullControllerResyncPeriod is how often the controller cache is fully
+	// relisted, to catch anything a watch event missed.
+	FullControllerResyncPeriod = 30 * time.Second
+	// PodRelistPeriod is how often the pod cache is fully relisted.
+	PodRelistPeriod = 5 * time.Minute
+)
+
+// PodControlInterface is responsible for creating and deleting the pods that
+// back a ReplicationController. It's pulled out of ReplicationManager so it
+// can be stubbed out in tests.
+type PodControlInterface interface {
+	createReplica(ctx context.Context, namespace string, controllerSpec api.ReplicationController)
+	deletePod(ctx context.Context, namespace, podID string) error
+	patchPod(ctx context.Context, namespace, podID string, patch []byte) error
+}
+
+// RealPodControl is the production implementation of PodControlInterface; it
+// talks to the apiserver through kubeClient.
+type RealPodControl struct {
+	kubeClient client.Interface
+}
+
+func (r RealPodControl) createReplica(ctx context.Context, namespace string, controllerSpec api.ReplicationController) {
+	desiredLabels := controllerSpec.DesiredState.PodTemplate.Labels
+	labels := make(map[string]string, len(desiredLabels)+1)
+	for k, v := range desiredLabels {
+		labels[k] = v
+	}
+	// Stamp the controller ref at creation time so the pod is never briefly
+	// unowned; an unowned pod in that window is fair game for adoption by any
+	// other controller whose selector happens to match it.
+	labels[controllerRefLabelKey] = controllerSpec.ID
+	pod := api.Pod{
+		JSONBase: api.JSONBase{
+			ID:        fmt.Sprintf("%08x", rand.Uint32()),
+			Namespace: namespace,
+		},
+		Labels:       labels,
+		DesiredState: controllerSpec.DesiredState.PodTemplate.DesiredState,
+	}
+	body, err := json.Marshal(pod)
+	if err != nil {
+		glog.Errorf("Unable to marshal pod: %#v", pod)
+		return
+	}
+	_, err = r.kubeClient.Post().Path("ns").Path(namespace).Path("pods").Body(body).Context(ctx).Do().Raw()
+	if err != nil {
+		glog.Errorf("Failed to create pod: %v", err)
+	}
+}
+
+func (r RealPodControl) deletePod(ctx context.Context, namespace, podID string) error {
+	return r.kubeClient.Delete().Path("ns").Path(namespace).Path("pods").Path(podID).Context(ctx).Do().Error()
+}
+
+func (r RealPodControl) patchPod(ctx context.Context, namespace, podID string, patch []byte) error {
+	return r.kubeClient.Patch().Path("ns").Path(namespace).Path("pods").Path(podID).Body(patch).Context(ctx).Do().Error()
+}
+
+// ReplicationManager keeps a cache of ReplicationControllers and pods fed by
+// watches against the apiserver, and syncs each affected controller's actual
+// pod count to its desired state as changes are observed.
+type ReplicationManager struct {
+	kubeClient   client.Interface
+	podControl   PodControlInterface
+	expectations *ControllerExpectations
+
+	// controllerStore is kept in sync with the apiserver via controllerController.
+	controllerStore cache.StoreToReplicationControllerLister
+	// podStore is kept in sync with the apiserver via podController.
+	podStore cache.StoreToPodLister
+
+	controllerController *framework.Controller
+	podController        *framework.Controller
+
+	// queue holds the keys of controllers that may need to be synced,
+	// deduplicating bursts of events for the same controller.
+	queue *workqueue.Type
+
+	// syncHandler is called with a controller's key for every item popped off
+	// queue. It's a struct field rather than a direct call to
+	// syncReplicationController so that tests can stub it out.
+	syncHandler func(ctx context.Context, key string) error
+}
+
+// MakeReplicationManager creates a new ReplicationManager backed by watches
+// against kubeClient rather than a direct etcd dependency.
+func MakeReplicationManager(kubeClient client.Interface) *ReplicationManager {
+	rm := &ReplicationManager{
+		kubeClient:   kubeClient,
+		podControl:   RealPodControl{kubeClient: kubeClient},
+		expectations: NewControllerExpectations(),
+		queue:        workqueue.New(),
+	}
+
+	rm.controllerStore.Store, rm.controllerController = framework.NewInformer(
+		&cache.ListWatch{
+			ListFunc: func() (runtime.Object, error) {
+				return rm.kubeClient.Get().Path("controllers").Do().Get()
+			},
+			WatchFunc: func(resourceVersion string) (watch.Interface, error) {
+				return rm.kubeClient.Get().Path("controllers").Watch(resourceVersion)
+			},
+		},
+		&api.ReplicationController{},
+		FullControllerResyncPeriod,
+		framework.ResourceEventHandlerFuncs{
+			AddFunc:    rm.enqueueController,
+			UpdateFunc: func(old, cur interface{}) { rm.enqueueController(cur) },
+			DeleteFunc: rm.enqueueController,
+		},
+	)
+
+	rm.podStore.Store, rm.podController = framework.NewInformer(
+		&cache.ListWatch{
+			ListFunc: func() (runtime.Object, error) {
+				return rm.kubeClient.Get().Path("pods").Do().Get()
+			},
+			WatchFunc: func(resourceVersion string) (watch.Interface, error) {
+				return rm.kubeClient.Get().Path("pods").Watch(resourceVersion)
+			},
+		},
+		&api.Pod{},
+		PodRelistPeriod,
+		framework.ResourceEventHandlerFuncs{
+			AddFunc:    rm.addPod,
+			UpdateFunc: rm.updatePod,
+			DeleteFunc: rm.deletePod,
+		},
+	)
+
+	rm.syncHandler = rm.syncReplicationController
+	return rm
+}
+
+// Run starts the watches and a pool of workers draining the sync queue. It
+// blocks until ctx is cancelled.
+func (rm *ReplicationManager) Run(ctx context.Context, workers int) {
+	defer util.HandleCrash()
+	stopCh := ctx.Done()
+	go rm.controllerController.Run(stopCh)
+	go rm.podController.Run(stopCh)
+	for i := 0; i < workers; i++ {
+		go util.Until(func() { rm.worker(ctx) }, time.Second, stopCh)
+	}
+	<-ctx.Done()
+	glog.Infof("Shutting down replication manager")
+	rm.queue.ShutDown()
+}
+
+// enqueueController adds the key of a ReplicationController object to the
+// sync queue. It's used as the add/update/delete handler for controllerController.
+func (rm *ReplicationManager) enqueueController(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		glog.Errorf("Couldn't get key for object %+v: %v", obj, err)
+		return
+	}
+	rm.queue.Add(key)
+}
+
+// addPod records an observed pod creation against the controller that owns
+// the pod, and re-enqueues the matching controllers in case this creation
+// fills out one that was waiting on it.
+func (rm *ReplicationManager) addPod(obj interface{}) {
+	pod := obj.(*api.Pod)
+	matching := rm.getPodControllers(pod)
+	if owner := rm.owningController(pod, matching); owner != nil {
+		rm.expectations.CreationObserved(*owner)
+	}
+	for _, rc := range matching {
+		rm.enqueueController(&rc)
+	}
+}
+
+// updatePod re-enqueues the controllers matching a pod's new state.
+func (rm *ReplicationManager) updatePod(old, cur interface{}) {
+	pod := cur.(*api.Pod)
+	for _, rc := range rm.getPodControllers(pod) {
+		rm.enqueueController(&rc)
+	}
+}
+
+// deletePod records an observed pod deletion against the controller that
+// owns the pod, and re-enqueues the matching controllers.
+func (rm *ReplicationManager) deletePod(obj interface{}) {
+	pod, ok := obj.(*api.Pod)
+	if !ok {
+		return
+	}
+	matching := rm.getPodControllers(pod)
+	if owner := rm.owningController(pod, matching); owner != nil {
+		rm.expectations.DeletionObserved(*owner)
+	}
+	for _, rc := range matching {
+		rm.enqueueController(&rc)
+	}
+}
+
+// getPodControllers returns the controllers in pod's own namespace whose
+// selector matches pod. GetPodControllers matches on labels alone, so without
+// this filter a pod event could be credited to a same-selector controller
+// living in a different namespace, breaking the isolation between tenants
+// that namespace scoping is meant to provide.
+func (rm *ReplicationManager) getPodControllers(pod *api.Pod) []api.ReplicationController {
+	rcs, err := rm.controllerStore.GetPodControllers(*pod)
+	if err != nil {
+		glog.V(4).Infof("No controllers found for pod %v: %v", pod.ID, err)
+		return nil
+	}
+	var matching []api.ReplicationController
+	for _, rc := range rcs {
+		if rc.Namespace == pod.Namespace {
+			matching = append(matching, rc)
+		}
+	}
+	return matching
+}
+
+// owningController picks the controller from matching (selector-matched
+// candidates for pod) that pod's ControllerRef actually names. A pod's
+// expectations should only ever be credited to the controller that created
+// it; crediting every selector match would let an unrelated controller with
+// an overlapping selector see its own pending creates/deletes satisfied by a
+// pod it didn't touch. If pod isn't owned yet, it falls back to treating it
+// as belonging to whichever single controller matches, mirroring adoptOrphan.
+func (rm *ReplicationManager) owningController(pod *api.Pod, matching []api.ReplicationController) *api.ReplicationController {
+	if ref := getControllerRef(*pod); ref != "" {
+		for i := range matching {
+			if matching[i].ID == ref {
+				return &matching[i]
+			}
+		}
+		return nil
+	}
+	if len(matching) == 1 {
+		return &matching[0]
+	}
+	return nil
+}
+
+// worker pops keys off queue and syncs them until queue is shut down. It
+// doesn't check ctx itself; Run shuts queue down once ctx is cancelled.
+func (rm *ReplicationManager) worker(ctx context.Context) {
+	for {
+		key, quit := rm.queue.Get()
+		if quit {
+			return
+		}
+		if err := rm.syncHandler(ctx, key.(string)); err != nil {
+			glog.Errorf("Error syncing replication controller %v: %v", key, err)
+		}
+		rm.queue.Done(key)
+	}
+}
+
+// syncReplicationController brings the number of pods backing the controller
+// named by key in line with its desired replica count. The pod creates and
+// deletes it issues run synchronously and are abandoned partway through if
+// ctx is cancelled before they complete.
+func (rm *ReplicationManager) syncReplicationController(ctx context.Context, key string) error {
+	obj, exists, err := rm.controllerStore.Store.GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		glog.Infof("Replication controller %v has been deleted", key)
+		namespace, name := splitNamespaceKey(key)
+		rm.expectations.DeleteExpectations(api.ReplicationController{JSONBase: api.JSONBase{ID: name, Namespace: namespace}})
+		return rm.releaseControllerRef(ctx, namespace, name)
+	}
+	controllerSpec := *obj.(*api.ReplicationController)
+
+	if !rm.expectations.SatisfiedExpectations(controllerSpec) {
+		glog.V(4).Infof("Controller %v still has unsatisfied expectations, skipping sync", key)
+		return nil
+	}
+
+	selector := labels.Set(controllerSpec.DesiredState.PodTemplate.Labels).AsSelector()
+	matching, err := rm.podStore.List(selector)
+	if err != nil {
+		return err
+	}
+	matching = filterByNamespace(matching, controllerSpec.Namespace)
+	owned, err := rm.adoptOrphan(ctx, controllerSpec, matching)
+	if err != nil {
+		return err
+	}
+	diff := len(owned) - controllerSpec.DesiredState.Replicas
+	switch {
+	case diff < 0:
+		creations := diff * -1
+		rm.expectations.ExpectCreations(controllerSpec, creations)
+		for i := 0; i < creations; i++ {
+			rm.podControl.createReplica(ctx, controllerSpec.Namespace, controllerSpec)
+		}
+	case diff > 0:
+		rm.expectations.ExpectDeletions(controllerSpec, diff)
+		for i := 0; i < diff; i++ {
+			if err := rm.podControl.deletePod(ctx, controllerSpec.Namespace, owned[i].ID); err != nil {
+				glog.Errorf("Failed to delete pod %v for controller %v: %v", owned[i].ID, controllerSpec.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// filterByNamespace returns the subset of pods in namespace. Two controllers
+// in different namespaces can otherwise share a label selector, so a
+// selector match alone isn't enough to decide a pod belongs to a controller.
+func filterByNamespace(pods []api.Pod, namespace string) []api.Pod {
+	var filtered []api.Pod
+	for _, pod := range pods {
+		if pod.Namespace == namespace {
+			filtered = append(filtered, pod)
+		}
+	}
+	return filtered
+}
+
+// splitNamespaceKey splits a "namespace/name" queue key into its parts.
+func splitNamespaceKey(key string) (namespace, name string) {
+	if i := strings.Index(key, "/"); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
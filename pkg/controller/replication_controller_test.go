@@ -17,49 +17,63 @@ limitations under the License.
 package controller
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http/httptest"
-	"reflect"
 	"testing"
 	"time"
 
+	"code.google.com/p/go.net/context"
 	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
 	"github.com/GoogleCloudPlatform/kubernetes/pkg/client"
 	"github.com/GoogleCloudPlatform/kubernetes/pkg/util"
-	"github.com/coreos/go-etcd/etcd"
 )
 
 // TODO: Move this to a common place, it's needed in multiple tests.
 var apiPath = "/api/v1beta1"
 
-// TODO: This doesn't reduce typing enough to make it worth the less readable errors. Remove.
-func expectNoError(t *testing.T, err error) {
-	if err != nil {
-		t.Errorf("Unexpected error: %#v", err)
-	}
-}
+// testNamespace is the namespace used by the controllers and pods the tests
+// in this file build, unless a test is specifically exercising namespace
+// isolation.
+const testNamespace = "default"
 
-func makeUrl(suffix string) string {
-	return apiPath + suffix
+func makeUrl(namespace, suffix string) string {
+	return apiPath + "/ns/" + namespace + suffix
 }
 
 type FakePodControl struct {
 	controllerSpec []api.ReplicationController
 	deletePodID    []string
+	patchPodID     []string
+	// createDelay, when set, is how long createReplica blocks before
+	// recording the create; a cancelled ctx ends the wait early and the
+	// create is not recorded, so tests can verify cancellation unblocks it.
+	createDelay time.Duration
 }
 
-func (f *FakePodControl) createReplica(spec api.ReplicationController) {
+func (f *FakePodControl) createReplica(ctx context.Context, namespace string, spec api.ReplicationController) {
+	if f.createDelay > 0 {
+		select {
+		case <-time.After(f.createDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
 	f.controllerSpec = append(f.controllerSpec, spec)
 }
 
-func (f *FakePodControl) deletePod(podID string) error {
+func (f *FakePodControl) deletePod(ctx context.Context, namespace, podID string) error {
 	f.deletePodID = append(f.deletePodID, podID)
 	return nil
 }
 
-func makeReplicationController(replicas int) api.ReplicationController {
+func (f *FakePodControl) patchPod(ctx context.Context, namespace, podID string, patch []byte) error {
+	f.patchPodID = append(f.patchPodID, podID)
+	return nil
+}
+
+func makeReplicationController(id string, replicas int) api.ReplicationController {
 	return api.ReplicationController{
+		JSONBase: api.JSONBase{ID: id, Namespace: testNamespace},
 		DesiredState: api.ReplicationControllerState{
 			Replicas: replicas,
 			PodTemplate: api.PodTemplate{
@@ -81,18 +95,21 @@ func makeReplicationController(replicas int) api.ReplicationController {
 	}
 }
 
-func makePodList(count int) api.PodList {
+func makePodList(count int) []api.Pod {
 	pods := []api.Pod{}
 	for i := 0; i < count; i++ {
 		pods = append(pods, api.Pod{
 			JSONBase: api.JSONBase{
-				ID: fmt.Sprintf("pod%d", i),
+				ID:        fmt.Sprintf("pod%d", i),
+				Namespace: testNamespace,
+			},
+			Labels: map[string]string{
+				"name": "foo",
+				"type": "production",
 			},
 		})
 	}
-	return api.PodList{
-		Items: pods,
-	}
+	return pods
 }
 
 func validateSyncReplication(t *testing.T, fakePodControl *FakePodControl, expectedCreates, expectedDeletes int) {
@@ -104,70 +121,97 @@ func validateSyncReplication(t *testing.T, fakePodControl *FakePodControl, expec
 	}
 }
 
-func TestSyncReplicationControllerDoesNothing(t *testing.T) {
-	body, _ := json.Marshal(makePodList(2))
-	fakeHandler := util.FakeHandler{
-		StatusCode:   200,
-		ResponseBody: string(body),
-	}
-	testServer := httptest.NewTLSServer(&fakeHandler)
-	client := client.Client{
-		Host: testServer.URL,
-	}
-
-	fakePodControl := FakePodControl{}
+func newReplicationManager() (*ReplicationManager, *FakePodControl) {
+	manager := MakeReplicationManager(client.Client{Host: ""})
+	fakePodControl := &FakePodControl{}
+	manager.podControl = fakePodControl
+	return manager, fakePodControl
+}
 
-	manager := MakeReplicationManager(nil, &client)
-	manager.podControl = &fakePodControl
+func TestSyncReplicationControllerDoesNothing(t *testing.T) {
+	manager, fakePodControl := newReplicationManager()
 
-	controllerSpec := makeReplicationController(2)
+	controllerSpec := makeReplicationController("foo", 2)
+	manager.controllerStore.Store.Add(&controllerSpec)
+	for _, pod := range makePodList(2) {
+		pod := pod
+		manager.podStore.Store.Add(&pod)
+	}
 
-	manager.syncReplicationController(controllerSpec)
-	validateSyncReplication(t, &fakePodControl, 0, 0)
+	if err := manager.syncReplicationController(context.Background(), key(controllerSpec)); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	validateSyncReplication(t, fakePodControl, 0, 0)
 }
 
 func TestSyncReplicationControllerDeletes(t *testing.T) {
-	body, _ := json.Marshal(makePodList(2))
-	fakeHandler := util.FakeHandler{
-		StatusCode:   200,
-		ResponseBody: string(body),
+	manager, fakePodControl := newReplicationManager()
+
+	controllerSpec := makeReplicationController("foo", 1)
+	manager.controllerStore.Store.Add(&controllerSpec)
+	for _, pod := range makePodList(2) {
+		pod := pod
+		manager.podStore.Store.Add(&pod)
 	}
-	testServer := httptest.NewTLSServer(&fakeHandler)
-	client := client.Client{
-		Host: testServer.URL,
+
+	if err := manager.syncReplicationController(context.Background(), key(controllerSpec)); err != nil {
+		t.Errorf("Unexpected error: %v", err)
 	}
+	validateSyncReplication(t, fakePodControl, 0, 1)
+}
+
+func TestSyncReplicationControllerCreates(t *testing.T) {
+	manager, fakePodControl := newReplicationManager()
 
-	fakePodControl := FakePodControl{}
+	controllerSpec := makeReplicationController("foo", 2)
+	manager.controllerStore.Store.Add(&controllerSpec)
 
-	manager := MakeReplicationManager(nil, &client)
-	manager.podControl = &fakePodControl
+	if err := manager.syncReplicationController(context.Background(), key(controllerSpec)); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	validateSyncReplication(t, fakePodControl, 2, 0)
+}
 
-	controllerSpec := makeReplicationController(1)
+func TestSyncReplicationControllerDeleted(t *testing.T) {
+	manager, fakePodControl := newReplicationManager()
 
-	manager.syncReplicationController(controllerSpec)
-	validateSyncReplication(t, &fakePodControl, 0, 1)
+	if err := manager.syncReplicationController(context.Background(), "missing"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	validateSyncReplication(t, fakePodControl, 0, 0)
 }
 
-func TestSyncReplicationControllerCreates(t *testing.T) {
-	body := "{ \"items\": [] }"
-	fakeHandler := util.FakeHandler{
-		StatusCode:   200,
-		ResponseBody: string(body),
+func TestSyncReplicationControllerDeletedReleasesOwnedPods(t *testing.T) {
+	manager, fakePodControl := newReplicationManager()
+
+	controllerSpec := makeReplicationController("foo", 1)
+	owned := makePodList(1)[0]
+	owned.Labels[controllerRefLabelKey] = controllerSpec.ID
+	manager.podStore.Store.Add(&owned)
+
+	// controllerSpec is deliberately not added to controllerStore, so the
+	// sync sees it as deleted. Its pod's ref must be cleared here, otherwise
+	// a later controller reusing the name "foo" would see adoptOrphan's
+	// ref-match fast path already satisfied and silently inherit this pod.
+	if err := manager.syncReplicationController(context.Background(), key(controllerSpec)); err != nil {
+		t.Errorf("Unexpected error: %v", err)
 	}
-	testServer := httptest.NewTLSServer(&fakeHandler)
-	client := client.Client{
-		Host: testServer.URL,
+	if len(fakePodControl.patchPodID) != 1 || fakePodControl.patchPodID[0] != owned.ID {
+		t.Errorf("Expected the deleted controller's pod to be released, got patches %v", fakePodControl.patchPodID)
 	}
+}
 
-	fakePodControl := FakePodControl{}
-
-	manager := MakeReplicationManager(nil, &client)
-	manager.podControl = &fakePodControl
+func TestSyncReplicationControllerRespectsExpectations(t *testing.T) {
+	manager, fakePodControl := newReplicationManager()
 
-	controllerSpec := makeReplicationController(2)
+	controllerSpec := makeReplicationController("foo", 2)
+	manager.controllerStore.Store.Add(&controllerSpec)
+	manager.expectations.ExpectCreations(controllerSpec, 2)
 
-	manager.syncReplicationController(controllerSpec)
-	validateSyncReplication(t, &fakePodControl, 2, 0)
+	if err := manager.syncReplicationController(context.Background(), key(controllerSpec)); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	validateSyncReplication(t, fakePodControl, 0, 0)
 }
 
 func TestCreateReplica(t *testing.T) {
@@ -205,265 +249,221 @@ func TestCreateReplica(t *testing.T) {
 		},
 	}
 
-	podControl.createReplica(controllerSpec)
+	podControl.createReplica(context.Background(), testNamespace, controllerSpec)
 
-	//expectedPod := Pod{
-	//	Labels:       controllerSpec.DesiredState.PodTemplate.Labels,
-	//	DesiredState: controllerSpec.DesiredState.PodTemplate.DesiredState,
-	//}
 	// TODO: fix this so that it validates the body.
-	fakeHandler.ValidateRequest(t, makeUrl("/pods"), "POST", nil)
+	fakeHandler.ValidateRequest(t, makeUrl(testNamespace, "/pods"), "POST", nil)
 }
 
-func TestHandleWatchResponseNotSet(t *testing.T) {
-	body, _ := json.Marshal(makePodList(2))
-	fakeHandler := util.FakeHandler{
-		StatusCode:   200,
-		ResponseBody: string(body),
-	}
-	testServer := httptest.NewTLSServer(&fakeHandler)
-	client := client.Client{
-		Host: testServer.URL,
-	}
+func TestAddPodDecrementsCreationExpectations(t *testing.T) {
+	manager, _ := newReplicationManager()
 
-	fakePodControl := FakePodControl{}
+	controllerSpec := makeReplicationController("foo", 2)
+	manager.controllerStore.Store.Add(&controllerSpec)
+	manager.expectations.ExpectCreations(controllerSpec, 1)
 
-	manager := MakeReplicationManager(nil, &client)
-	manager.podControl = &fakePodControl
-	_, err := manager.handleWatchResponse(&etcd.Response{
-		Action: "delete",
-	})
-	expectNoError(t, err)
-}
+	pod := makePodList(1)[0]
+	manager.addPod(&pod)
 
-func TestHandleWatchResponseNoNode(t *testing.T) {
-	body, _ := json.Marshal(makePodList(2))
-	fakeHandler := util.FakeHandler{
-		StatusCode:   200,
-		ResponseBody: string(body),
-	}
-	testServer := httptest.NewTLSServer(&fakeHandler)
-	client := client.Client{
-		Host: testServer.URL,
+	if !manager.expectations.SatisfiedExpectations(controllerSpec) {
+		t.Errorf("Expected creation expectation to be satisfied after observing the pod add")
 	}
+}
 
-	fakePodControl := FakePodControl{}
+func TestAdoptsMatchingOrphanPods(t *testing.T) {
+	manager, fakePodControl := newReplicationManager()
 
-	manager := MakeReplicationManager(nil, &client)
-	manager.podControl = &fakePodControl
-	_, err := manager.handleWatchResponse(&etcd.Response{
-		Action: "set",
-	})
-	if err == nil {
-		t.Error("Unexpected non-error")
-	}
-}
+	controllerSpec := makeReplicationController("foo", 2)
+	manager.controllerStore.Store.Add(&controllerSpec)
 
-func TestHandleWatchResponseBadData(t *testing.T) {
-	body, _ := json.Marshal(makePodList(2))
-	fakeHandler := util.FakeHandler{
-		StatusCode:   200,
-		ResponseBody: string(body),
+	owned := makePodList(1)[0]
+	owned.ID = "pod-owned"
+	owned.Labels[controllerRefLabelKey] = controllerSpec.ID
+	unowned := makePodList(1)[0]
+	unowned.ID = "pod-unowned"
+	manager.podStore.Store.Add(&owned)
+	manager.podStore.Store.Add(&unowned)
+
+	if err := manager.syncReplicationController(context.Background(), key(controllerSpec)); err != nil {
+		t.Errorf("Unexpected error: %v", err)
 	}
-	testServer := httptest.NewTLSServer(&fakeHandler)
-	client := client.Client{
-		Host: testServer.URL,
+	// Both pods match the selector once the unowned one is adopted, so with
+	// 2 pods now counted against 2 desired replicas there's nothing left to
+	// create or delete.
+	validateSyncReplication(t, fakePodControl, 0, 0)
+	if len(fakePodControl.patchPodID) != 1 || fakePodControl.patchPodID[0] != unowned.ID {
+		t.Errorf("Expected an adoption patch for %v, got %v", unowned.ID, fakePodControl.patchPodID)
 	}
+}
 
-	fakePodControl := FakePodControl{}
+func TestUpdateSelectorOrphansPods(t *testing.T) {
+	manager, fakePodControl := newReplicationManager()
 
-	manager := MakeReplicationManager(nil, &client)
-	manager.podControl = &fakePodControl
-	_, err := manager.handleWatchResponse(&etcd.Response{
-		Action: "set",
-		Node: &etcd.Node{
-			Value: "foobar",
-		},
-	})
-	if err == nil {
-		t.Error("Unexpected non-error")
-	}
-}
+	controllerSpec := makeReplicationController("foo", 1)
+	manager.controllerStore.Store.Add(&controllerSpec)
 
-func TestHandleWatchResponse(t *testing.T) {
-	body, _ := json.Marshal(makePodList(2))
-	fakeHandler := util.FakeHandler{
-		StatusCode:   200,
-		ResponseBody: string(body),
+	owned := makePodList(1)[0]
+	owned.Labels[controllerRefLabelKey] = controllerSpec.ID
+	manager.podStore.Store.Add(&owned)
+
+	// Narrow the controller's selector so it no longer matches the pod it
+	// previously owned.
+	controllerSpec.DesiredState.PodTemplate.Labels = map[string]string{"name": "bar"}
+	manager.controllerStore.Store.Add(&controllerSpec)
+
+	if err := manager.syncReplicationController(context.Background(), key(controllerSpec)); err != nil {
+		t.Errorf("Unexpected error: %v", err)
 	}
-	testServer := httptest.NewTLSServer(&fakeHandler)
-	client := client.Client{
-		Host: testServer.URL,
+	if len(fakePodControl.patchPodID) != 1 || fakePodControl.patchPodID[0] != owned.ID {
+		t.Errorf("Expected a release patch for %v, got %v", owned.ID, fakePodControl.patchPodID)
 	}
+	// The orphaned pod no longer counts toward the controller, so a
+	// replacement is created to fill the gap.
+	validateSyncReplication(t, fakePodControl, 1, 0)
+}
 
-	fakePodControl := FakePodControl{}
+func TestSyncDoesNotAdoptPodsOwnedByAnOverlappingController(t *testing.T) {
+	manager, fakePodControl := newReplicationManager()
 
-	manager := MakeReplicationManager(nil, &client)
-	manager.podControl = &fakePodControl
+	// owner and other both select the same labels, as can happen when two
+	// controllers' selectors overlap, but only owner created pod.
+	owner := makeReplicationController("owner", 1)
+	other := makeReplicationController("other", 1)
+	manager.controllerStore.Store.Add(&owner)
+	manager.controllerStore.Store.Add(&other)
 
-	controller := makeReplicationController(2)
+	pod := makePodList(1)[0]
+	pod.Labels[controllerRefLabelKey] = owner.ID
+	manager.podStore.Store.Add(&pod)
 
-	data, err := json.Marshal(controller)
-	expectNoError(t, err)
-	controllerOut, err := manager.handleWatchResponse(&etcd.Response{
-		Action: "set",
-		Node: &etcd.Node{
-			Value: string(data),
-		},
-	})
-	if err != nil {
-		t.Errorf("Unexpected error: %#v", err)
+	// Syncing other must not adopt pod out from under owner; since other has
+	// no pods of its own, it should create one instead.
+	if err := manager.syncReplicationController(context.Background(), key(other)); err != nil {
+		t.Errorf("Unexpected error: %v", err)
 	}
-	if !reflect.DeepEqual(controller, *controllerOut) {
-		t.Errorf("Unexpected mismatch.  Expected %#v, Saw: %#v", controller, controllerOut)
+	validateSyncReplication(t, fakePodControl, 1, 0)
+	if len(fakePodControl.patchPodID) != 0 {
+		t.Errorf("Expected no adoption patches, got %v", fakePodControl.patchPodID)
 	}
+
+	// Syncing owner should see pod as already satisfying its replica count.
+	if err := manager.syncReplicationController(context.Background(), key(owner)); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	validateSyncReplication(t, fakePodControl, 1, 0)
 }
 
-func TestSyncronize(t *testing.T) {
-	controllerSpec1 := api.ReplicationController{
-		DesiredState: api.ReplicationControllerState{
-			Replicas: 4,
-			PodTemplate: api.PodTemplate{
-				DesiredState: api.PodState{
-					Manifest: api.ContainerManifest{
-						Containers: []api.Container{
-							{
-								Image: "foo/bar",
-							},
-						},
-					},
-				},
-				Labels: map[string]string{
-					"name": "foo",
-					"type": "production",
-				},
-			},
-		},
+func TestAddPodCreditsOnlyTheOwningController(t *testing.T) {
+	manager, _ := newReplicationManager()
+
+	// owner and other both match pod's labels, but only owner's ControllerRef
+	// is stamped on it.
+	owner := makeReplicationController("owner", 1)
+	other := makeReplicationController("other", 1)
+	manager.controllerStore.Store.Add(&owner)
+	manager.controllerStore.Store.Add(&other)
+	manager.expectations.ExpectCreations(owner, 1)
+	manager.expectations.ExpectCreations(other, 1)
+
+	pod := makePodList(1)[0]
+	pod.Labels[controllerRefLabelKey] = owner.ID
+	manager.addPod(&pod)
+
+	if !manager.expectations.SatisfiedExpectations(owner) {
+		t.Errorf("Expected owner's creation expectation to be satisfied after observing its pod")
 	}
-	controllerSpec2 := api.ReplicationController{
-		DesiredState: api.ReplicationControllerState{
-			Replicas: 3,
-			PodTemplate: api.PodTemplate{
-				DesiredState: api.PodState{
-					Manifest: api.ContainerManifest{
-						Containers: []api.Container{
-							{
-								Image: "bar/baz",
-							},
-						},
-					},
-				},
-				Labels: map[string]string{
-					"name": "bar",
-					"type": "production",
-				},
-			},
-		},
+	if manager.expectations.SatisfiedExpectations(other) {
+		t.Errorf("other did not create this pod; its expectation should still be outstanding")
 	}
+}
 
-	fakeEtcd := util.MakeFakeEtcdClient(t)
-	fakeEtcd.Data["/registry/controllers"] = util.EtcdResponseWithError{
-		R: &etcd.Response{
-			Node: &etcd.Node{
-				Nodes: []*etcd.Node{
-					{
-						Value: util.MakeJSONString(controllerSpec1),
-					},
-					{
-						Value: util.MakeJSONString(controllerSpec2),
-					},
-				},
-			},
-		},
-	}
+func TestAddPodIgnoresSameSelectorControllerInOtherNamespace(t *testing.T) {
+	manager, _ := newReplicationManager()
 
-	fakeHandler := util.FakeHandler{
-		StatusCode:   200,
-		ResponseBody: "{}",
-		T:            t,
+	owner := makeReplicationController("foo", 1)
+	manager.controllerStore.Store.Add(&owner)
+	otherNamespace := owner
+	otherNamespace.Namespace = "other"
+	manager.controllerStore.Store.Add(&otherNamespace)
+	manager.expectations.ExpectCreations(owner, 1)
+	manager.expectations.ExpectCreations(otherNamespace, 1)
+
+	pod := makePodList(1)[0]
+	pod.Labels[controllerRefLabelKey] = owner.ID
+	manager.addPod(&pod)
+
+	if !manager.expectations.SatisfiedExpectations(owner) {
+		t.Errorf("Expected owner's creation expectation to be satisfied after observing its pod")
 	}
-	testServer := httptest.NewTLSServer(&fakeHandler)
-	client := client.Client{
-		Host: testServer.URL,
+	if manager.expectations.SatisfiedExpectations(otherNamespace) {
+		t.Errorf("A same-selector controller in another namespace must not be credited with pod's creation")
 	}
-	manager := MakeReplicationManager(fakeEtcd, client)
-	fakePodControl := FakePodControl{}
-	manager.podControl = &fakePodControl
+}
 
-	manager.synchronize()
+func TestDeletePodDecrementsDeletionExpectations(t *testing.T) {
+	manager, _ := newReplicationManager()
 
-	validateSyncReplication(t, &fakePodControl, 7, 0)
-}
+	controllerSpec := makeReplicationController("foo", 1)
+	manager.controllerStore.Store.Add(&controllerSpec)
+	manager.expectations.ExpectDeletions(controllerSpec, 1)
 
-type asyncTimeout struct {
-	doneChan chan bool
-}
+	pod := makePodList(1)[0]
+	manager.deletePod(&pod)
 
-func beginTimeout(d time.Duration) *asyncTimeout {
-	a := &asyncTimeout{doneChan: make(chan bool)}
-	go func() {
-		select {
-		case <-a.doneChan:
-			return
-		case <-time.After(d):
-			panic("Timeout expired!")
-		}
-	}()
-	return a
+	if !manager.expectations.SatisfiedExpectations(controllerSpec) {
+		t.Errorf("Expected deletion expectation to be satisfied after observing the pod delete")
+	}
 }
 
-func (a *asyncTimeout) done() {
-	close(a.doneChan)
-}
+func TestSyncIgnoresPodsInOtherNamespaces(t *testing.T) {
+	manager, fakePodControl := newReplicationManager()
 
-func TestWatchControllers(t *testing.T) {
-	defer beginTimeout(20 * time.Second).done()
-	fakeEtcd := util.MakeFakeEtcdClient(t)
-	manager := MakeReplicationManager(fakeEtcd, nil)
-	var testControllerSpec api.ReplicationController
-	receivedCount := 0
-	manager.syncHandler = func(controllerSpec api.ReplicationController) error {
-		if !reflect.DeepEqual(controllerSpec, testControllerSpec) {
-			t.Errorf("Expected %#v, but got %#v", testControllerSpec, controllerSpec)
-		}
-		receivedCount++
-		return nil
-	}
+	controllerSpec := makeReplicationController("foo", 1)
+	manager.controllerStore.Store.Add(&controllerSpec)
 
-	go manager.watchControllers()
-	time.Sleep(10 * time.Millisecond)
+	otherNamespacePod := makePodList(1)[0]
+	otherNamespacePod.Namespace = "other"
+	manager.podStore.Store.Add(&otherNamespacePod)
 
-	// Test normal case
-	testControllerSpec.ID = "foo"
-	fakeEtcd.WatchResponse <- &etcd.Response{
-		Action: "set",
-		Node: &etcd.Node{
-			Value: util.MakeJSONString(testControllerSpec),
-		},
+	if err := manager.syncReplicationController(context.Background(), key(controllerSpec)); err != nil {
+		t.Errorf("Unexpected error: %v", err)
 	}
+	// A same-selector pod in a different namespace isn't this controller's
+	// pod, so it should be created in testNamespace rather than counted.
+	validateSyncReplication(t, fakePodControl, 1, 0)
+}
 
-	time.Sleep(10 * time.Millisecond)
-	if receivedCount != 1 {
-		t.Errorf("Expected 1 call but got %v", receivedCount)
-	}
+func TestSyncAbandonsInFlightCreateOnContextCancel(t *testing.T) {
+	manager, fakePodControl := newReplicationManager()
+	fakePodControl.createDelay = time.Minute
 
-	// Test error case
-	fakeEtcd.WatchInjectError <- fmt.Errorf("Injected error")
-	time.Sleep(10 * time.Millisecond)
+	controllerSpec := makeReplicationController("foo", 1)
+	manager.controllerStore.Store.Add(&controllerSpec)
 
-	// Did everything shut down?
-	if _, open := <-fakeEtcd.WatchResponse; open {
-		t.Errorf("An injected error did not cause a graceful shutdown")
-	}
+	// Cancel up front so the create synchronously started inside
+	// syncReplicationController observes a done context rather than racing
+	// its own cancellation; this is equivalent to Run shutting down mid-sync.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
 
-	// Test purposeful shutdown
-	go manager.watchControllers()
-	time.Sleep(10 * time.Millisecond)
-	fakeEtcd.WatchStop <- true
-	time.Sleep(10 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		if err := manager.syncReplicationController(ctx, key(controllerSpec)); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		close(done)
+	}()
 
-	// Did everything shut down?
-	if _, open := <-fakeEtcd.WatchResponse; open {
-		t.Errorf("A stop did not cause a graceful shutdown")
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("syncReplicationController did not return within 1s of its context being cancelled")
+	}
+	// The create was abandoned rather than completed, so it must not be
+	// recorded, and the expectation it set up is left outstanding rather than
+	// satisfied by a pod that was never actually created.
+	validateSyncReplication(t, fakePodControl, 0, 0)
+	if manager.expectations.SatisfiedExpectations(controllerSpec) {
+		t.Errorf("Expected the create expectation to remain outstanding after the create was abandoned")
 	}
 }